@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// defaultScrollRetries is how many times Exporter.Do retries a scroll
+// request after a transient error before giving up.
+const defaultScrollRetries = 5
+
+// backoffDuration returns how long to wait before retrying the given
+// (zero indexed) attempt, doubling the base delay each time and adding
+// jitter so that multiple exporters hitting the same cluster don't
+// retry in lockstep. The delay is capped at 30s.
+func backoffDuration(attempt int) time.Duration {
+	base := 200 * time.Millisecond * time.Duration(uint(1)<<uint(attempt))
+	if base > 30*time.Second {
+		base = 30 * time.Second
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// isTransientErr reports whether err looks like a transient error
+// Elasticsearch returns when it is temporarily overloaded (429 Too Many
+// Requests) or unavailable (503 Service Unavailable), which are worth
+// retrying instead of aborting the export.
+func isTransientErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "429") ||
+		strings.Contains(msg, "503") ||
+		strings.Contains(msg, "Too Many Requests") ||
+		strings.Contains(msg, "Service Unavailable")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDurationBounds(t *testing.T) {
+	cases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 200 * time.Millisecond},
+		{1, 400 * time.Millisecond},
+		{5, 6400 * time.Millisecond},
+		{20, 30 * time.Second}, // large enough to hit the 30s cap
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			d := backoffDuration(c.attempt)
+			if d < 0 || d > c.max {
+				t.Fatalf("backoffDuration(%d) = %s, want within [0, %s]", c.attempt, d, c.max)
+			}
+		}
+	}
+}
+
+func TestIsTransientErr(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("elastic: Error 429 (Too Many Requests)"), true},
+		{errors.New("elastic: Error 503 (Service Unavailable)"), true},
+		{errors.New("elastic: Error 404 (Not Found)"), false},
+		{errors.New("dial tcp: connection refused"), false},
+	}
+
+	for _, c := range cases {
+		if got := isTransientErr(c.err); got != c.want {
+			t.Errorf("isTransientErr(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
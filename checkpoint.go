@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// checkpointSchemaVersion guards against loading a checkpoint written
+// by an incompatible future version of this tool.
+const checkpointSchemaVersion = 1
+
+// exportCheckpoint is the on-disk state Exporter.Do writes periodically
+// while -checkpoint is set, and reads back on startup to resume an
+// export that was interrupted. LastSort holds the sort values of the
+// last document written, so the search_after iteration can pick up
+// exactly where it left off. ParamsHash ties the checkpoint to the
+// index/type/fields/query/sort-field it was taken against, so resuming
+// with different parameters is rejected instead of silently producing
+// corrupted output.
+type exportCheckpoint struct {
+	SchemaVersion int           `json:"schema_version"`
+	ParamsHash    string        `json:"params_hash"`
+	SortField     string        `json:"sort_field"`
+	LastSort      []interface{} `json:"last_sort"`
+	DocsWritten   int64         `json:"docs_written"`
+}
+
+// checkpointParamsHash hashes everything that must stay identical
+// between the run that wrote a checkpoint and the run that resumes
+// from it.
+func checkpointParamsHash(index string, types, fields []string, sortField string, query elastic.Query) (string, error) {
+	var querySource interface{}
+	if query != nil {
+		querySource = query.Source()
+	}
+
+	data, err := json.Marshal(struct {
+		Index     string      `json:"index"`
+		Types     []string    `json:"types"`
+		Fields    []string    `json:"fields"`
+		SortField string      `json:"sort_field"`
+		Query     interface{} `json:"query"`
+	}{index, types, fields, sortField, querySource})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadCheckpoint reads a checkpoint previously written to path. It
+// returns a nil checkpoint and no error when path doesn't exist yet, so
+// the first run of an export just starts fresh.
+func loadCheckpoint(path string) (*exportCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cp exportCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint[%s] is corrupted: %s", path, err.Error())
+	}
+	if cp.SchemaVersion != checkpointSchemaVersion {
+		return nil, fmt.Errorf("checkpoint[%s] has schema version %d, expected %d", path, cp.SchemaVersion, checkpointSchemaVersion)
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint atomically writes cp to path: it writes to a temporary
+// file in the same directory and renames it over path, so a process
+// killed mid-write never leaves a corrupted checkpoint behind.
+func saveCheckpoint(path string, cp *exportCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// searchAfterCursor drives a search_after based export: each Next call
+// issues one plain search request for the page following the sort
+// values of the last hit it returned, instead of relying on a
+// server-side scroll context. That makes it resumable - an interrupted
+// export can start its next run from the last saved sort values - and
+// lets it carry a {"slice":{"id","max"}} clause for Exporter.Slices,
+// since Elasticsearch 5.0+ rejects the search_type=scan the elastic.v2
+// client's ScanService always sends, and sliced scroll needs 5.0+.
+type searchAfterCursor struct {
+	ex          *Exporter
+	searchAfter []interface{}
+	sliceID     int
+	sliceMax    int
+	done        bool
+}
+
+// newSearchAfterCursor returns a searchAfterCursor that starts from
+// searchAfter - the LastSort of a resumed checkpoint, or nil to start
+// from the beginning - restricted to slice (sliceID, sliceMax) if
+// sliceMax > 1.
+func newSearchAfterCursor(ex *Exporter, searchAfter []interface{}, sliceID, sliceMax int) *searchAfterCursor {
+	return &searchAfterCursor{ex: ex, searchAfter: searchAfter, sliceID: sliceID, sliceMax: sliceMax}
+}
+
+// Next implements docIterator.
+func (c *searchAfterCursor) Next() (*elastic.SearchResult, error) {
+	if c.done {
+		return nil, elastic.EOS
+	}
+
+	result, err := c.ex.searchAfterPage(c.searchAfter, c.sliceID, c.sliceMax)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Hits.Hits) == 0 {
+		c.done = true
+		return nil, elastic.EOS
+	}
+
+	c.searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	return result, nil
+}
+
+// searchAfterPage runs the single search request behind one
+// searchAfterCursor.Next call. Results are sorted by ex.sortField with
+// "_uid" as a tiebreaker, since search_after requires a globally unique
+// ordering to guarantee every document is visited exactly once. When
+// sliceMax > 1, the body carries a {"slice":{"id","max"}} clause so
+// Elasticsearch partitions the search_after iteration into sliceMax
+// disjoint slices that can be consumed independently.
+func (ex *Exporter) searchAfterPage(searchAfter []interface{}, sliceID, sliceMax int) (*elastic.SearchResult, error) {
+	query := ex.query
+	if query == nil {
+		query = elastic.NewMatchAllQuery()
+	}
+
+	size := ex.size
+	if size <= 0 {
+		size = ex.bulkSize
+	}
+
+	source := elastic.NewSearchSource().
+		Fields(ex.fields...).
+		FetchSource(ex.needsSource).
+		Query(query).
+		Size(size).
+		Sort(ex.sortField, true).
+		Sort("_uid", true)
+
+	body := source.Source().(map[string]interface{})
+	if len(searchAfter) > 0 {
+		body["search_after"] = searchAfter
+	}
+	if sliceMax > 1 {
+		body["slice"] = map[string]interface{}{"id": sliceID, "max": sliceMax}
+	}
+
+	search := ex.client.Search(ex.index).Source(body)
+	if len(ex.types) > 0 {
+		search = search.Types(ex.types...)
+	}
+	return search.Do()
+}
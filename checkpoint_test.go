@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+func TestCheckpointParamsHashStableAndSensitive(t *testing.T) {
+	base, err := checkpointParamsHash("logs", []string{"event"}, []string{"host"}, "_doc", nil)
+	if err != nil {
+		t.Fatalf("checkpointParamsHash: %s", err)
+	}
+
+	again, err := checkpointParamsHash("logs", []string{"event"}, []string{"host"}, "_doc", nil)
+	if err != nil {
+		t.Fatalf("checkpointParamsHash: %s", err)
+	}
+	if base != again {
+		t.Fatal("checkpointParamsHash is not stable across identical calls")
+	}
+
+	cases := []struct {
+		name   string
+		index  string
+		types  []string
+		fields []string
+		sort   string
+		query  elastic.Query
+	}{
+		{"index", "other-index", []string{"event"}, []string{"host"}, "_doc", nil},
+		{"types", "logs", []string{"other-type"}, []string{"host"}, "_doc", nil},
+		{"fields", "logs", []string{"event"}, []string{"status"}, "_doc", nil},
+		{"sortField", "logs", []string{"event"}, []string{"host"}, "@timestamp", nil},
+		{"query", "logs", []string{"event"}, []string{"host"}, "_doc", elastic.NewMatchAllQuery()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hash, err := checkpointParamsHash(c.index, c.types, c.fields, c.sort, c.query)
+			if err != nil {
+				t.Fatalf("checkpointParamsHash: %s", err)
+			}
+			if hash == base {
+				t.Fatalf("changing %s did not change the params hash", c.name)
+			}
+		})
+	}
+}
+
+func TestSaveLoadCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	cp := &exportCheckpoint{
+		SchemaVersion: checkpointSchemaVersion,
+		ParamsHash:    "abc123",
+		SortField:     "_doc",
+		LastSort:      []interface{}{float64(42)},
+		DocsWritten:   1000,
+	}
+	if err := saveCheckpoint(path, cp); err != nil {
+		t.Fatalf("saveCheckpoint: %s", err)
+	}
+
+	got, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %s", err)
+	}
+	if got == nil || got.ParamsHash != cp.ParamsHash || got.DocsWritten != cp.DocsWritten {
+		t.Fatalf("loadCheckpoint = %#v, want %#v", got, cp)
+	}
+}
+
+func TestLoadCheckpointMissingFile(t *testing.T) {
+	cp, err := loadCheckpoint(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %s", err)
+	}
+	if cp != nil {
+		t.Fatalf("loadCheckpoint(missing) = %#v, want nil", cp)
+	}
+}
+
+func TestLoadCheckpointRejectsWrongSchemaVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := saveCheckpoint(path, &exportCheckpoint{SchemaVersion: checkpointSchemaVersion + 1}); err != nil {
+		t.Fatalf("saveCheckpoint: %s", err)
+	}
+
+	if _, err := loadCheckpoint(path); err == nil {
+		t.Fatal("loadCheckpoint with a future schema version: want error, got nil")
+	}
+}
+
+// TestExporterResumingAppendsNotTruncates is a regression test for a
+// review finding where Do() always truncated -output and rewrote the
+// header even when resuming, silently dropping every row the checkpoint
+// being resumed from was meant to preserve. Resuming is what main uses
+// to decide whether to open -output for appending instead.
+func TestExporterResumingAppendsNotTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	ex := NewExporter(nil, "logs").Fields("host", "status")
+	ex.Checkpoint(path)
+
+	resuming, err := ex.Resuming()
+	if err != nil {
+		t.Fatalf("Resuming with no checkpoint file: %s", err)
+	}
+	if resuming {
+		t.Fatal("Resuming with no checkpoint file = true, want false")
+	}
+
+	hash, err := checkpointParamsHash(ex.index, ex.types, ex.fields, "_doc", ex.query)
+	if err != nil {
+		t.Fatalf("checkpointParamsHash: %s", err)
+	}
+	if err := saveCheckpoint(path, &exportCheckpoint{
+		SchemaVersion: checkpointSchemaVersion,
+		ParamsHash:    hash,
+		SortField:     "_doc",
+		DocsWritten:   10,
+	}); err != nil {
+		t.Fatalf("saveCheckpoint: %s", err)
+	}
+
+	resuming, err = ex.Resuming()
+	if err != nil {
+		t.Fatalf("Resuming with a matching checkpoint: %s", err)
+	}
+	if !resuming {
+		t.Fatal("Resuming with a matching checkpoint = false, want true")
+	}
+}
+
+func TestExporterResumingRejectsMismatchedCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	if err := saveCheckpoint(path, &exportCheckpoint{
+		SchemaVersion: checkpointSchemaVersion,
+		ParamsHash:    "some-other-hash",
+	}); err != nil {
+		t.Fatalf("saveCheckpoint: %s", err)
+	}
+
+	ex := NewExporter(nil, "logs").Fields("host", "status")
+	ex.Checkpoint(path)
+
+	if _, err := ex.Resuming(); err == nil {
+		t.Fatal("Resuming with a checkpoint for a different index/fields/query: want error, got nil")
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/csv"
 	"errors"
 	"fmt"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/NeowayLabs/logger"
 
@@ -13,20 +15,32 @@ import (
 
 // Exporter ...
 type Exporter struct {
-	client   *elastic.Client
-	index    string
-	types    []string
-	query    elastic.Query
-	fields   []string
-	bulkSize int
-	size     int
-	scroll   string
-	progress ExporterProgressFunc
-	writer   *csv.Writer
+	client     *elastic.Client
+	index      string
+	types      []string
+	query      elastic.Query
+	fields     []string
+	bulkSize   int
+	size       int
+	scroll     string
+	workers    int
+	maxRetries int
+	slices     int
+	sliceID    int
+	sliceMax   int
+	progress   ExporterProgressFunc
+	writer     ExportWriter
+
+	checkpointPath string
+	sortField      string
+	needsSource    bool
+
+	startedAt   time.Time
+	docsWritten int64
+	retries     int64
+	batches     chan scanBatch
 }
 
-var bulkSize = 1000
-
 // ExporterProgressFunc is a callback that can be used with Exporter
 // to report progress while reindexing data.
 type ExporterProgressFunc func(current, total int64)
@@ -38,6 +52,49 @@ type ExporterResponse struct {
 	Errors  []*elastic.BulkResponseItem
 }
 
+// ExporterStats is a snapshot of an in-progress or finished Do() call,
+// returned by Exporter.Stats.
+type ExporterStats struct {
+	DocsPerSec   float64
+	BytesWritten int64
+	Retries      int64
+	QueueDepth   int
+}
+
+// scanBatch is one page of hits pulled from the scan cursor, tagged
+// with the order it was scanned in so the writer goroutine can apply
+// batches in scan order even though the formatter goroutines that
+// handled them may finish out of order.
+type scanBatch struct {
+	seq  int64
+	hits []*elastic.SearchHit
+}
+
+// encodedDoc is one document after a formatter goroutine has run it
+// through ExportWriter.EncodeDoc, paired with the sort values off its
+// originating hit so the writer goroutine can checkpoint from it
+// without needing the hit itself.
+type encodedDoc struct {
+	data []byte
+	sort []interface{}
+}
+
+// encodedBatch is the encoded form of a scanBatch, carrying the same
+// seq so the writer goroutine can still apply batches in scan order.
+type encodedBatch struct {
+	seq  int64
+	docs []encodedDoc
+}
+
+// docIterator yields successive pages of hits until it is exhausted, at
+// which point it returns elastic.EOS. *elastic.ScanCursor implements
+// this to drive a normal scroll; searchAfterCursor implements it to
+// drive a search_after based export that can be checkpointed and
+// resumed.
+type docIterator interface {
+	Next() (*elastic.SearchResult, error)
+}
+
 // NewExporter returns a new Exporter.
 func NewExporter(client *elastic.Client, index string) *Exporter {
 	return &Exporter{
@@ -84,8 +141,9 @@ func (ex *Exporter) Query(query elastic.Query) *Exporter {
 	return ex
 }
 
-// Writer will be used to write documents from elastic search to file, for example
-func (ex *Exporter) Writer(writer *csv.Writer) *Exporter {
+// Writer sets the ExportWriter used to encode documents read from
+// Elasticsearch to the destination output.
+func (ex *Exporter) Writer(writer ExportWriter) *Exporter {
 	ex.writer = writer
 	return ex
 }
@@ -111,6 +169,114 @@ func (ex *Exporter) Progress(f ExporterProgressFunc) *Exporter {
 	return ex
 }
 
+// Workers sets how many goroutines format hits pulled off the scroll
+// cursor concurrently. The default is 1 (no parallelism).
+func (ex *Exporter) Workers(workers int) *Exporter {
+	ex.workers = workers
+	return ex
+}
+
+// Retries sets how many times Do retries a scroll request after a
+// transient Elasticsearch error (429/503) before giving up.
+// The default is 5.
+func (ex *Exporter) Retries(retries int) *Exporter {
+	ex.maxRetries = retries
+	return ex
+}
+
+// Slices splits the scan into n independent sliced-scroll cursors and
+// runs them concurrently, fanning their hits into the same writer
+// pipeline. Use this to parallelize a single export process across a
+// large index. The default is 1 (a single, unsliced scroll).
+func (ex *Exporter) Slices(n int) *Exporter {
+	ex.slices = n
+	return ex
+}
+
+// Slice restricts this Exporter to a single slice (id, out of max) of
+// a sliced scroll, so independent processes - potentially on different
+// hosts - can each consume one slice and their outputs concatenated
+// afterwards. It is ignored when Slices is also set.
+func (ex *Exporter) Slice(id, max int) *Exporter {
+	ex.sliceID = id
+	ex.sliceMax = max
+	return ex
+}
+
+// Checkpoint enables resumable exports: Do periodically saves its
+// progress to path, and resumes from it on startup if it already
+// exists and matches the current index/type/fields/query/sort-field.
+// It is incompatible with Slices/Slice, since resuming relies on a
+// single, globally ordered search_after iteration. The default is no
+// checkpointing.
+func (ex *Exporter) Checkpoint(path string) *Exporter {
+	ex.checkpointPath = path
+	return ex
+}
+
+// SortField sets the field Checkpoint orders documents by when
+// iterating with search_after. The default is "_doc".
+func (ex *Exporter) SortField(field string) *Exporter {
+	ex.sortField = field
+	return ex
+}
+
+// Resuming reports whether Do would resume from an existing checkpoint
+// matching this export's index/type/fields/query/sort-field, rather
+// than starting fresh. Callers that open the destination output
+// themselves, like main, use this to decide whether to append to it
+// instead of truncating it.
+func (ex *Exporter) Resuming() (bool, error) {
+	if ex.checkpointPath == "" {
+		return false, nil
+	}
+
+	sortField := ex.sortField
+	if sortField == "" {
+		sortField = "_doc"
+	}
+
+	paramsHash, err := checkpointParamsHash(ex.index, ex.types, ex.fields, sortField, ex.query)
+	if err != nil {
+		return false, err
+	}
+
+	checkpoint, err := loadCheckpoint(ex.checkpointPath)
+	if err != nil {
+		return false, err
+	}
+	if checkpoint == nil {
+		return false, nil
+	}
+	if checkpoint.ParamsHash != paramsHash {
+		return false, fmt.Errorf("checkpoint[%s] does not match this export's index/type/fields/query/sort-field, refusing to resume", ex.checkpointPath)
+	}
+	return true, nil
+}
+
+// Stats returns a snapshot of the exporter's progress. It is safe to
+// call concurrently with Do().
+func (ex *Exporter) Stats() ExporterStats {
+	docs := atomic.LoadInt64(&ex.docsWritten)
+
+	var docsPerSec float64
+	if elapsed := time.Since(ex.startedAt).Seconds(); elapsed > 0 {
+		docsPerSec = float64(docs) / elapsed
+	}
+
+	var bytesWritten int64
+	if bw, ok := ex.writer.(BytesWriter); ok {
+		bytesWritten = bw.BytesWritten()
+	}
+
+	return ExporterStats{
+		DocsPerSec:   docsPerSec,
+		BytesWritten: bytesWritten,
+		Retries:      atomic.LoadInt64(&ex.retries),
+		QueueDepth:   len(ex.batches),
+	}
+}
+
 // Do starts the exporting process.
 func (ex *Exporter) Do() (*ExporterResponse, error) {
 	if ex.client == nil {
@@ -131,120 +297,339 @@ func (ex *Exporter) Do() (*ExporterResponse, error) {
 	if ex.scroll == "" {
 		ex.scroll = "5m"
 	}
+	if ex.workers <= 0 {
+		ex.workers = 1
+	}
+	if ex.maxRetries <= 0 {
+		ex.maxRetries = defaultScrollRetries
+	}
+	if ex.checkpointPath != "" && (ex.slices > 1 || ex.sliceMax > 1) {
+		return nil, errors.New("checkpoint is not supported together with Slices/Slice")
+	}
+	if ex.sortField == "" {
+		ex.sortField = "_doc"
+	}
+	ex.needsSource = true
+	if sw, ok := ex.writer.(SourceOptionalWriter); ok {
+		ex.needsSource = sw.NeedsSource()
+	}
 
-	// Count total to report progress (if necessary)
+	// A checkpoint ties its resume position to the exact
+	// index/type/fields/query/sort-field it was taken against, so
+	// paramsHash is computed up front: once to validate a checkpoint
+	// being resumed from, and again every time Do saves a new one.
+	var checkpoint *exportCheckpoint
+	var paramsHash string
 	var err error
+	if ex.checkpointPath != "" {
+		paramsHash, err = checkpointParamsHash(ex.index, ex.types, ex.fields, ex.sortField, ex.query)
+		if err != nil {
+			return nil, err
+		}
+
+		checkpoint, err = loadCheckpoint(ex.checkpointPath)
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint != nil && checkpoint.ParamsHash != paramsHash {
+			return nil, fmt.Errorf("checkpoint[%s] does not match this export's index/type/fields/query/sort-field, refusing to resume", ex.checkpointPath)
+		}
+		if checkpoint != nil {
+			ex.docsWritten = checkpoint.DocsWritten
+		}
+	}
+
+	// Count total to report progress (if necessary). On a resumed
+	// export, current starts from the docs a previous run already
+	// wrote, so the reported percentage picks up where that run left
+	// off instead of plateauing below 100%.
 	var current, total int64
 	if ex.progress != nil {
 		total, err = ex.count()
 		if err != nil {
 			return nil, err
 		}
+		if checkpoint != nil {
+			current = checkpoint.DocsWritten
+		}
 	}
 
-	// Prepare scan and scroll to iterate through the source index
-	scanner := ex.client.Scan(ex.index).Scroll(ex.scroll).Fields(ex.fields...)
-	if len(ex.types) > 0 {
-		scanner = scanner.Types(ex.types...)
-	}
-	if ex.query != nil {
-		scanner = scanner.Query(ex.query)
-	}
-	if ex.size > 0 {
-		scanner = scanner.Size(ex.size)
+	// Open one cursor per slice. Slices > 1 fans this single export out
+	// across sliceCount concurrent cursors; otherwise there's exactly
+	// one cursor, optionally pinned to a single external slice via
+	// Slice(id, max). Sliced exports, and checkpointed ones, are driven
+	// by search_after cursors: Elasticsearch dropped search_type=scan in
+	// 5.0, the same release sliced scroll requires, so newScanner's plain
+	// scroll (which the elastic.v2 client always sends as search_type=scan)
+	// cannot be used for either.
+	sliceCount := ex.slices
+	if sliceCount <= 1 {
+		sliceCount = 1
 	}
 
-	cursor, err := scanner.Do()
+	cursors := make([]docIterator, sliceCount)
+	switch {
+	case ex.checkpointPath != "":
+		var searchAfter []interface{}
+		if checkpoint != nil {
+			searchAfter = checkpoint.LastSort
+		}
+		cursors[0] = newSearchAfterCursor(ex, searchAfter, 0, 0)
+	case ex.slices > 1:
+		for i := 0; i < sliceCount; i++ {
+			cursors[i] = newSearchAfterCursor(ex, nil, i, ex.slices)
+		}
+	case ex.sliceMax > 1:
+		cursors[0] = newSearchAfterCursor(ex, nil, ex.sliceID, ex.sliceMax)
+	default:
+		cursor, err := ex.newScanner().Do()
+		if err != nil {
+			return nil, err
+		}
+		cursors[0] = cursor
+	}
 
-	bulk := 0
+	return ex.drain(cursors, checkpoint, paramsHash, current, total)
+}
 
+// drain runs the producer/formatter/writer pipeline over cursors: each
+// cursor is scrolled by its own producer goroutine, hits are encoded
+// concurrently by ex.workers formatter goroutines, and the results are
+// reassembled in scan order and written out by the single caller
+// goroutine below. It is split out of Do so the reassembly logic can be
+// exercised against a fake docIterator in tests, without a live
+// Elasticsearch client.
+func (ex *Exporter) drain(cursors []docIterator, checkpoint *exportCheckpoint, paramsHash string, current, total int64) (*ExporterResponse, error) {
 	ret := &ExporterResponse{
 		Errors: make([]*elastic.BulkResponseItem, 0),
 	}
 
-	if err := ex.writer.Write(ex.fields); err != nil {
-		return nil, err
+	// A resumed export appends to a writer already holding the rows from
+	// the run the checkpoint came from, so it must not repeat the header.
+	// CSVWriter still gets the field order WriteHeader would have set.
+	if checkpoint == nil {
+		if err := ex.writer.WriteHeader(ex.fields); err != nil {
+			return nil, err
+		}
+	} else if cw, ok := ex.writer.(*CSVWriter); ok {
+		cw.fields = ex.fields
 	}
 
-	ex.writer.Flush()
-	err = ex.writer.Error()
-	if err != nil {
+	if err := ex.writer.Flush(); err != nil {
 		logger.Fatal("Error flushing to file: %s", err.Error())
 	}
 
-	// Main loop iterates through the source index and bulk indexes into target.
-	for {
-		docs, err := cursor.Next()
-		if err == elastic.EOS {
-			break
-		}
-		if err != nil {
-			return ret, err
-		}
-
-		if docs.TotalHits() > 0 {
-			for _, hit := range docs.Hits.Hits {
-				if ex.progress != nil {
-					current++
-					ex.progress(current, total)
+	ex.startedAt = time.Now()
+
+	// Each cursor gets its own producer goroutine driving its scroll and
+	// pushing pages of hits into a bounded, shared channel; when the
+	// formatter goroutines fall behind, the channel fills up and the
+	// producers block, applying back-pressure instead of buffering the
+	// whole index in memory. seq is shared by every producer so the
+	// writer goroutine sees a single, increasing sequence regardless of
+	// how many slices are running concurrently.
+	ex.batches = make(chan scanBatch, ex.workers*2)
+	formatted := make(chan encodedBatch, ex.workers*2)
+
+	var seq int64
+	var producerErr error
+	var producerErrOnce sync.Once
+	var producers sync.WaitGroup
+	producers.Add(len(cursors))
+	for _, cursor := range cursors {
+		cursor := cursor
+		go func() {
+			defer producers.Done()
+			for {
+				docs, err := ex.scrollNext(cursor)
+				if err == elastic.EOS {
+					return
+				}
+				if err != nil {
+					producerErrOnce.Do(func() { producerErr = err })
+					return
 				}
+				if docs.TotalHits() == 0 {
+					continue
+				}
+				ex.batches <- scanBatch{seq: atomic.AddInt64(&seq, 1) - 1, hits: docs.Hits.Hits}
+			}
+		}()
+	}
 
-				var values []string
-				for _, field := range ex.fields {
-					if hit.Fields[field] == nil {
-						values = append(values, "")
+	producerDone := make(chan struct{})
+	go func() {
+		producers.Wait()
+		close(ex.batches)
+		close(producerDone)
+	}()
+
+	// N formatter goroutines pull batches off the producer and run each
+	// hit through ExportWriter.EncodeDoc - the CPU-bound encoding work -
+	// concurrently, then hand the encoded bytes to the single writer
+	// goroutine below. EncodeDoc must not touch any state WriteEncoded
+	// also touches, so it's safe to call from multiple goroutines at
+	// once; ExportWriter implementations enforce that by keeping
+	// WriteEncoded's state (e.g. JSONArrayWriter.started) out of reach
+	// of EncodeDoc entirely.
+	var formatters sync.WaitGroup
+	formatters.Add(ex.workers)
+	for i := 0; i < ex.workers; i++ {
+		go func() {
+			defer formatters.Done()
+			for batch := range ex.batches {
+				docs := make([]encodedDoc, 0, len(batch.hits))
+				for _, hit := range batch.hits {
+					data, err := ex.writer.EncodeDoc(hit)
+					if err != nil {
+						logger.Warn("Error encoding document: %s", err.Error())
 						continue
 					}
+					docs = append(docs, encodedDoc{data: data, sort: hit.Sort})
+				}
+				formatted <- encodedBatch{seq: batch.seq, docs: docs}
+			}
+		}()
+	}
+	go func() {
+		formatters.Wait()
+		close(formatted)
+	}()
+
+	// The writer goroutine is the only one calling WriteEncoded/Flush on
+	// ex.writer, so those never need to be safe for concurrent use.
+	// Batches are buffered by seq until their predecessor has been
+	// written, so CSV/NDJSON output stays in scan order even if
+	// formatters finish out of order.
+	bulk := 0
+	pending := make(map[int64]encodedBatch)
+	var next int64
+	var lastSort []interface{}
+	if checkpoint != nil {
+		lastSort = checkpoint.LastSort
+	}
+	for batch := range formatted {
+		pending[batch.seq] = batch
+		for {
+			b, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
 
-					value := hit.Fields[field].([]interface{})
-					items := make([]string, len(value))
-
-					for i, item := range value {
-						switch t := item.(type) {
-						case string:
-							items[i] = item.(string)
-						case bool:
-							items[i] = fmt.Sprintf("%t", item)
-						case float64:
-							items[i] = fmt.Sprintf("%f", item)
-						default:
-							logger.Error("unexpected type %T\n", t)
-						}
-					}
-
-					values = append(values, strings.Join(items, "\n"))
+			for _, doc := range b.docs {
+				if ex.progress != nil {
+					current++
+					ex.progress(current, total)
 				}
 
-				if err := ex.writer.Write(values); err != nil {
+				if err := ex.writer.WriteEncoded(doc.data); err != nil {
 					logger.Warn("Error writing to file: %s", err.Error())
 					continue
 				}
+				atomic.AddInt64(&ex.docsWritten, 1)
+				if ex.checkpointPath != "" {
+					lastSort = doc.sort
+				}
 
 				bulk++
-				if bulk >= bulkSize {
+				if bulk >= ex.bulkSize {
 					bulk = 0
 
-					ex.writer.Flush()
-					err = ex.writer.Error()
-					if err != nil {
+					if err := ex.writer.Flush(); err != nil {
 						logger.Fatal("Error flushing to file: %s", err.Error())
 					}
+					if ex.checkpointPath != "" {
+						if err := ex.saveCheckpoint(paramsHash, lastSort); err != nil {
+							logger.Warn("Error saving checkpoint[%s]: %s", ex.checkpointPath, err.Error())
+						}
+					}
 				}
 			}
 		}
 	}
 
+	<-producerDone
+	if producerErr != nil {
+		return ret, producerErr
+	}
+
 	if bulk >= 0 {
-		ex.writer.Flush()
-		err = ex.writer.Error()
-		if err != nil {
+		if err := ex.writer.Flush(); err != nil {
 			logger.Fatal("Error flushing to file: %s", err.Error())
 		}
+		if ex.checkpointPath != "" {
+			// The cursor ran to completion, so there's no position left
+			// to resume from: drop the checkpoint instead of saving one,
+			// so a later rerun of the same command starts a fresh export
+			// rather than "resuming" a finished one with a stale or nil
+			// LastSort and re-appending the whole index onto -output.
+			if err := os.Remove(ex.checkpointPath); err != nil && !os.IsNotExist(err) {
+				logger.Warn("Error removing checkpoint[%s] after successful export: %s", ex.checkpointPath, err.Error())
+			}
+		}
 	}
 
 	return ret, nil
 }
 
+// saveCheckpoint persists ex's current progress to ex.checkpointPath, so
+// a future run given the same checkpoint can resume from lastSort
+// instead of restarting the export.
+func (ex *Exporter) saveCheckpoint(paramsHash string, lastSort []interface{}) error {
+	return saveCheckpoint(ex.checkpointPath, &exportCheckpoint{
+		SchemaVersion: checkpointSchemaVersion,
+		ParamsHash:    paramsHash,
+		SortField:     ex.sortField,
+		LastSort:      lastSort,
+		DocsWritten:   atomic.LoadInt64(&ex.docsWritten),
+	})
+}
+
+// scrollNext advances the scan cursor, retrying transient
+// Elasticsearch errors (429/503) with exponential backoff and jitter
+// up to ex.maxRetries times before giving up.
+func (ex *Exporter) scrollNext(cursor docIterator) (*elastic.SearchResult, error) {
+	for attempt := 0; ; attempt++ {
+		docs, err := cursor.Next()
+		if err == nil || err == elastic.EOS {
+			return docs, err
+		}
+		if !isTransientErr(err) || attempt >= ex.maxRetries {
+			return nil, err
+		}
+
+		atomic.AddInt64(&ex.retries, 1)
+		wait := backoffDuration(attempt)
+		logger.Warn("Transient error scrolling index <%s> (attempt %d/%d): %s. Retrying in %s",
+			ex.index, attempt+1, ex.maxRetries, err.Error(), wait)
+		time.Sleep(wait)
+	}
+}
+
+// newScanner builds the ScanService used to open the plain, unsliced
+// scroll cursor. It is never used for Slices/Slice or Checkpoint: those
+// paginate via search_after instead (see searchAfterPage), since the
+// elastic.v2 client's Scan always sends search_type=scan, which
+// Elasticsearch 5.0+ - the same release sliced scroll requires -
+// rejects.
+func (ex *Exporter) newScanner() *elastic.ScanService {
+	scanner := ex.client.Scan(ex.index).Scroll(ex.scroll)
+	if len(ex.types) > 0 {
+		scanner = scanner.Types(ex.types...)
+	}
+
+	scanner = scanner.Fields(ex.fields...).FetchSource(ex.needsSource)
+	if ex.query != nil {
+		scanner = scanner.Query(ex.query)
+	}
+	if ex.size > 0 {
+		scanner = scanner.Size(ex.size)
+	}
+	return scanner
+}
+
 // count returns the number of documents in the source index.
 // The query is taken into account, if specified.
 func (ex *Exporter) count() (int64, error) {
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"time"
@@ -21,14 +21,55 @@ var (
 	fieldlist string
 	fields    []string
 	output    string
+	format    string
+	workers   int
+	sliceID   int
+	sliceMax  int
+
+	queryFile   string
+	queryString string
+	since       string
+	until       string
+	timeField   string
+
+	sniff              bool
+	username           string
+	password           string
+	caCert             string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+	maxRetries         int
+
+	checkpointPath string
+	sortField      string
 )
 
 func main() {
-	flag.StringVar(&host, "host", defaultElasticSearch, "elastic search host to get data from")
+	flag.StringVar(&host, "host", defaultElasticSearch, "comma-separated list of elastic search hosts to get data from")
 	flag.StringVar(&index, "index", "", "name of index to export")
 	flag.StringVar(&indexType, "type", "", "name of type inside of <index> to export [optional]")
 	flag.StringVar(&fieldlist, "fieldlist", "", "list of fields to export")
-	flag.StringVar(&output, "output", "", "name of file to output")
+	flag.StringVar(&output, "output", "", "name of file to output, or - for stdout")
+	flag.StringVar(&format, "format", "csv", "output format: csv, ndjson or json")
+	flag.IntVar(&workers, "workers", 1, "number of goroutines formatting hits concurrently")
+	flag.IntVar(&sliceID, "slice-id", 0, "id of the sliced scroll slice to export, 0-based [optional]")
+	flag.IntVar(&sliceMax, "slice-max", 0, "total number of slices the index is divided into [optional]")
+	flag.StringVar(&queryFile, "query-file", "", "path to a JSON file with an Elasticsearch query DSL [optional]")
+	flag.StringVar(&queryString, "query-string", "", "Lucene query string to filter the export [optional]")
+	flag.StringVar(&since, "since", "", "only export documents with -time-field >= since [optional]")
+	flag.StringVar(&until, "until", "", "only export documents with -time-field <= until [optional]")
+	flag.StringVar(&timeField, "time-field", "", "field used by -since/-until to filter by time range [optional]")
+	flag.BoolVar(&sniff, "sniff", false, "discover the rest of the cluster's nodes from -host [optional]")
+	flag.StringVar(&username, "username", "", "HTTP basic auth username [optional]")
+	flag.StringVar(&password, "password", "", "HTTP basic auth password [optional]")
+	flag.StringVar(&caCert, "ca-cert", "", "path to a PEM CA certificate used to verify the cluster [optional]")
+	flag.StringVar(&clientCert, "client-cert", "", "path to a PEM client certificate for mutual TLS [optional]")
+	flag.StringVar(&clientKey, "client-key", "", "path to the PEM key for -client-cert [optional]")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "skip TLS certificate verification [optional]")
+	flag.IntVar(&maxRetries, "max-retries", 0, "max number of retries the ES client performs per request [optional]")
+	flag.StringVar(&checkpointPath, "checkpoint", "", "path to a checkpoint file to resume an interrupted export from, incompatible with -slice-max [optional]")
+	flag.StringVar(&sortField, "sort-field", "", "field used to order documents when -checkpoint is set, default _doc [optional]")
 
 	flag.Parse()
 
@@ -40,7 +81,17 @@ func main() {
 	}
 
 	// Connect to client
-	client, err := getESClient(host)
+	client, err := getESClient(esClientConfig{
+		hosts:              strings.Split(host, ","),
+		sniff:              sniff,
+		username:           username,
+		password:           password,
+		caCert:             caCert,
+		clientCert:         clientCert,
+		clientKey:          clientKey,
+		insecureSkipVerify: insecureSkipVerify,
+		maxRetries:         maxRetries,
+	})
 	if err != nil {
 		logger.Fatal("Error connecting to `%s`: %+v", host, err.Error())
 	}
@@ -68,27 +119,59 @@ func main() {
 		logger.Fatal("Fields informed is invalid")
 	}
 
-	file, err := os.Create(output)
-	if err != nil {
-		logger.Fatal("Cannot create output file[%s]: %s", output, err.Error())
-	}
-
-	csvWriter := csv.NewWriter(file)
-	csvWriter.Comma = ';'
-
 	// Export index/type to output
 	exporter := NewExporter(client, index).Size(10).BulkSize(1000)
 	if indexType != "" {
 		exporter = exporter.Type(indexType)
 	}
 	exporter.Fields(fields...)
-	exporter.Writer(csvWriter)
-	exporter.Progress(showExportProgress)
+	exporter.Workers(workers)
+	if sliceMax > 1 {
+		exporter.Slice(sliceID, sliceMax)
+	}
+	if checkpointPath != "" {
+		exporter.Checkpoint(checkpointPath)
+		if sortField != "" {
+			exporter.SortField(sortField)
+		}
+	}
+	exporter.Progress(func(current, total int64) {
+		showExportProgress(current, total, exporter.Stats())
+	})
 
-	// Implement HERE your search quey
-	query := elastic.NewMatchAllQuery()
+	query, err := buildQuery(queryFile, queryString, since, until, timeField)
+	if err != nil {
+		logger.Fatal("Error building query: %s", err.Error())
+	}
 	exporter.Query(query)
 
+	// A resumed export must append to -output, not truncate it: the
+	// checkpoint's search_after position only makes sense on top of the
+	// rows a previous, interrupted run already wrote there.
+	resuming, err := exporter.Resuming()
+	if err != nil {
+		logger.Fatal("Error checking checkpoint[%s]: %s", checkpointPath, err.Error())
+	}
+
+	var file *os.File
+	switch {
+	case output == "-":
+		file = os.Stdout
+	case resuming:
+		file, err = os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	default:
+		file, err = os.Create(output)
+	}
+	if err != nil {
+		logger.Fatal("Cannot open output file[%s]: %s", output, err.Error())
+	}
+
+	writer, err := newExportWriter(format, file, resuming)
+	if err != nil {
+		logger.Fatal("Error building writer: %s", err.Error())
+	}
+	exporter.Writer(writer)
+
 	logger.Info("Starting exporting to <%s>...", output)
 	exportStart = time.Now()
 
@@ -97,7 +180,13 @@ func main() {
 		logger.Fatal("Error trying exporting: %+v", err.Error())
 	}
 
+	if err := writer.Close(); err != nil {
+		logger.Fatal("Error closing writer: %s", err.Error())
+	}
+
+	finalStats := exporter.Stats()
 	logger.Info("Exported was completed in <%s>, %d documents successed and %d failed", time.Since(exportStart), resp.Success, resp.Failed)
+	logger.Info("Final stats: %.1f docs/s, %d bytes written, %d retries", finalStats.DocsPerSec, finalStats.BytesWritten, finalStats.Retries)
 
 	if len(resp.Errors) > 0 {
 		logger.Warn("We get errors in some documents...")
@@ -108,19 +197,69 @@ func main() {
 	}
 }
 
-func getESClient(esURL string) (*elastic.Client, error) {
-	esClient, err := elastic.NewClient(
-		elastic.SetURL(esURL),
-		elastic.SetSniff(false),
+// newExportWriter builds the ExportWriter for the given -format flag,
+// writing to w. resuming is forwarded to formats whose encoding depends
+// on whether w already holds a previous run's output (see
+// NewJSONArrayWriter).
+func newExportWriter(format string, w *os.File, resuming bool) (ExportWriter, error) {
+	switch format {
+	case "csv":
+		return NewCSVWriter(w), nil
+	case "ndjson":
+		return NewNDJSONWriter(w), nil
+	case "json":
+		return NewJSONArrayWriter(w, resuming), nil
+	default:
+		return nil, fmt.Errorf("unknown format <%s>, expected one of: csv, ndjson, json", format)
+	}
+}
+
+// esClientConfig holds everything needed to dial the source
+// Elasticsearch cluster: one or more node URLs, sniffing, TLS and HTTP
+// basic auth.
+type esClientConfig struct {
+	hosts              []string
+	sniff              bool
+	username           string
+	password           string
+	caCert             string
+	clientCert         string
+	clientKey          string
+	insecureSkipVerify bool
+	maxRetries         int
+}
+
+func getESClient(cfg esClientConfig) (*elastic.Client, error) {
+	opts := []elastic.ClientOptionFunc{
+		elastic.SetURL(cfg.hosts...),
+		elastic.SetSniff(cfg.sniff),
 		elastic.SetErrorLog(logger.DefaultLogger.Handlers[0].(*logger.DefaultHandler).ErrorLogger),
 		elastic.SetInfoLog(logger.DefaultLogger.Handlers[0].(*logger.DefaultHandler).DebugLogger),
 		elastic.SetTraceLog(logger.DefaultLogger.Handlers[0].(*logger.DefaultHandler).DebugLogger),
-	)
+	}
+
+	if cfg.username != "" || cfg.password != "" {
+		opts = append(opts, elastic.SetBasicAuth(cfg.username, cfg.password))
+	}
+
+	if cfg.maxRetries > 0 {
+		opts = append(opts, elastic.SetMaxRetries(cfg.maxRetries))
+	}
+
+	if cfg.caCert != "" || cfg.clientCert != "" || cfg.clientKey != "" || cfg.insecureSkipVerify {
+		httpClient, err := newTLSHTTPClient(cfg.caCert, cfg.clientCert, cfg.clientKey, cfg.insecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, elastic.SetHttpClient(httpClient))
+	}
 
+	esClient, err := elastic.NewClient(opts...)
 	if err != nil {
 		return esClient, err
 	}
 
+	esURL := cfg.hosts[0]
 	esVersion, err := esClient.ElasticsearchVersion(esURL)
 	if err != nil {
 		logger.Fatal("Error getting ES version: %+v", err.Error())
@@ -135,10 +274,11 @@ var (
 	exportStart    time.Time
 )
 
-func showExportProgress(current, total int64) {
+func showExportProgress(current, total int64, stats ExporterStats) {
 	percent := (float64(current) / float64(total)) * 100
 	if int(percent) > exportProgress {
 		exportProgress = int(percent)
-		logger.Info("Exporting... %d%% [Time elapsed: %s]", exportProgress, time.Since(exportStart).String())
+		logger.Info("Exporting... %d%% [Time elapsed: %s] [%.1f docs/s, %d bytes written, %d retries, queue depth %d]",
+			exportProgress, time.Since(exportStart).String(), stats.DocsPerSec, stats.BytesWritten, stats.Retries, stats.QueueDepth)
 	}
 }
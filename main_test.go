@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeESServer serves just enough of the Elasticsearch HTTP API for
+// elastic.NewClient's startup healthcheck and ElasticsearchVersion to
+// succeed: a 200 on HEAD /, and a minimal version document on GET /.
+// It records every request it receives so tests can assert on auth and
+// which host(s) were actually dialed.
+func fakeESServer(t *testing.T) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []*http.Request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version": map[string]string{"number": "5.6.0"},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestGetESClientDialsGivenHosts(t *testing.T) {
+	srv, requests := fakeESServer(t)
+
+	client, err := getESClient(esClientConfig{hosts: []string{srv.URL}})
+	if err != nil {
+		t.Fatalf("getESClient: %s", err)
+	}
+	if client == nil {
+		t.Fatal("getESClient returned a nil client with no error")
+	}
+
+	if len(*requests) == 0 {
+		t.Fatal("getESClient never dialed the configured host")
+	}
+}
+
+func TestGetESClientSendsBasicAuth(t *testing.T) {
+	srv, requests := fakeESServer(t)
+
+	if _, err := getESClient(esClientConfig{
+		hosts:    []string{srv.URL},
+		username: "alice",
+		password: "s3cret",
+	}); err != nil {
+		t.Fatalf("getESClient: %s", err)
+	}
+
+	var sawAuth bool
+	for _, r := range *requests {
+		if user, pass, ok := r.BasicAuth(); ok && user == "alice" && pass == "s3cret" {
+			sawAuth = true
+		}
+	}
+	if !sawAuth {
+		t.Fatal("getESClient never sent the configured basic-auth credentials")
+	}
+}
+
+func TestGetESClientSplitsMultipleHosts(t *testing.T) {
+	srvA, _ := fakeESServer(t)
+	srvB, _ := fakeESServer(t)
+
+	hosts := strings.Split(srvA.URL+","+srvB.URL, ",")
+	if len(hosts) != 2 {
+		t.Fatalf("hosts = %v, want 2 entries", hosts)
+	}
+
+	client, err := getESClient(esClientConfig{hosts: hosts})
+	if err != nil {
+		t.Fatalf("getESClient: %s", err)
+	}
+	if client == nil {
+		t.Fatal("getESClient returned a nil client with no error")
+	}
+}
+
+func TestGetESClientTLSErrorIsSurfaced(t *testing.T) {
+	_, err := getESClient(esClientConfig{
+		hosts:  []string{"https://127.0.0.1:1"},
+		caCert: "/nonexistent/ca.pem",
+	})
+	if err == nil {
+		t.Fatal("getESClient: expected error for a missing ca-cert, got nil")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// buildQuery assembles the elastic.Query to run for the export from
+// the relevant CLI flags. queryFile loads an arbitrary Elasticsearch
+// query DSL document, queryString builds a Lucene query string query,
+// and since/until build a range filter over timeField. Any combination
+// of these is merged with a bool must; with none of them set, it
+// exports everything via MatchAll.
+func buildQuery(queryFile, queryString, since, until, timeField string) (elastic.Query, error) {
+	var clauses []elastic.Query
+
+	if queryFile != "" {
+		data, err := ioutil.ReadFile(queryFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read query file[%s]: %s", queryFile, err.Error())
+		}
+		clauses = append(clauses, elastic.NewRawStringQuery(string(data)))
+	}
+
+	if queryString != "" {
+		clauses = append(clauses, elastic.NewQueryStringQuery(queryString))
+	}
+
+	if since != "" || until != "" {
+		if timeField == "" {
+			return nil, errors.New("-time-field is required when -since or -until is set")
+		}
+
+		rangeQuery := elastic.NewRangeQuery(timeField)
+		if since != "" {
+			rangeQuery = rangeQuery.Gte(since)
+		}
+		if until != "" {
+			rangeQuery = rangeQuery.Lte(until)
+		}
+		clauses = append(clauses, rangeQuery)
+	}
+
+	switch len(clauses) {
+	case 0:
+		return elastic.NewMatchAllQuery(), nil
+	case 1:
+		return clauses[0], nil
+	default:
+		return elastic.NewBoolQuery().Must(clauses...), nil
+	}
+}
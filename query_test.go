@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBuildQueryDefaultsToMatchAll(t *testing.T) {
+	query, err := buildQuery("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("buildQuery: %s", err)
+	}
+
+	src := query.Source()
+	if _, ok := src.(map[string]interface{})["match_all"]; !ok {
+		t.Fatalf("buildQuery with no flags = %#v, want match_all", src)
+	}
+}
+
+func TestBuildQueryRequiresTimeFieldForRange(t *testing.T) {
+	if _, err := buildQuery("", "", "2020-01-01", "", ""); err == nil {
+		t.Fatal("buildQuery with -since but no -time-field: want error, got nil")
+	}
+}
+
+func TestBuildQuerySingleClauseIsNotWrapped(t *testing.T) {
+	query, err := buildQuery("", "host:foo", "", "", "")
+	if err != nil {
+		t.Fatalf("buildQuery: %s", err)
+	}
+
+	src := query.Source()
+	if _, ok := src.(map[string]interface{})["query_string"]; !ok {
+		t.Fatalf("buildQuery with only -query-string = %#v, want an unwrapped query_string clause", src)
+	}
+}
+
+func TestBuildQueryCombinesClausesWithBoolMust(t *testing.T) {
+	query, err := buildQuery("", "host:foo", "2020-01-01", "2020-02-01", "@timestamp")
+	if err != nil {
+		t.Fatalf("buildQuery: %s", err)
+	}
+
+	src := query.Source()
+	boolClause, ok := src.(map[string]interface{})["bool"]
+	if !ok {
+		t.Fatalf("buildQuery with -query-string and -since/-until = %#v, want a bool query", src)
+	}
+	must, ok := boolClause.(map[string]interface{})["must"].([]interface{})
+	if !ok || len(must) != 2 {
+		t.Fatalf("buildQuery bool.must = %#v, want 2 clauses", boolClause)
+	}
+}
+
+func TestBuildQueryReadsQueryFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "es-export-query-*.json")
+	if err != nil {
+		t.Fatalf("TempFile: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(`{"term":{"status":"ok"}}`); err != nil {
+		t.Fatalf("WriteString: %s", err)
+	}
+	f.Close()
+
+	query, err := buildQuery(f.Name(), "", "", "", "")
+	if err != nil {
+		t.Fatalf("buildQuery: %s", err)
+	}
+
+	src := query.Source()
+	if _, ok := src.(map[string]interface{})["term"]; !ok {
+		t.Fatalf("buildQuery with -query-file = %#v, want the raw query_file body", src)
+	}
+}
+
+func TestBuildQueryMissingQueryFile(t *testing.T) {
+	if _, err := buildQuery("/nonexistent/query.json", "", "", "", ""); err == nil {
+		t.Fatal("buildQuery with a missing -query-file: want error, got nil")
+	}
+}
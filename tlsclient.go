@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// newTLSHTTPClient builds an *http.Client configured for TLS, used when
+// -ca-cert, -client-cert/-client-key or -insecure-skip-verify is set.
+// caCert verifies the server's certificate, clientCert/clientKey enable
+// mutual TLS, and insecureSkipVerify disables certificate verification
+// entirely (for clusters with self-signed certificates).
+func newTLSHTTPClient(caCert, clientCert, clientKey string, insecureSkipVerify bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca-cert[%s]: %s", caCert, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca-cert[%s]", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client-cert/client-key: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
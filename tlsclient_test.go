@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateCert writes a throwaway self-signed certificate and private
+// key, PEM encoded, to certPath/keyPath.
+func generateCert(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "es-export-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+
+	writePEMFile(t, certPath, "CERTIFICATE", der)
+	writePEMFile(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+}
+
+func writePEMFile(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create %s: %s", path, err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatalf("pem.Encode: %s", err)
+	}
+}
+
+func TestNewTLSHTTPClientInsecureSkipVerify(t *testing.T) {
+	client, err := newTLSHTTPClient("", "", "", true)
+	if err != nil {
+		t.Fatalf("newTLSHTTPClient: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("InsecureSkipVerify = false, want true")
+	}
+}
+
+func TestNewTLSHTTPClientLoadsCACert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca.key")
+	generateCert(t, certPath, keyPath)
+
+	client, err := newTLSHTTPClient(certPath, "", "", false)
+	if err != nil {
+		t.Fatalf("newTLSHTTPClient: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig.RootCAs == nil {
+		t.Fatal("RootCAs = nil, want the loaded ca-cert pool")
+	}
+}
+
+func TestNewTLSHTTPClientMissingCACert(t *testing.T) {
+	_, err := newTLSHTTPClient(filepath.Join(t.TempDir(), "missing.pem"), "", "", false)
+	if err == nil {
+		t.Fatal("newTLSHTTPClient: expected error for missing ca-cert, got nil")
+	}
+}
+
+func TestNewTLSHTTPClientInvalidCACert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	_, err := newTLSHTTPClient(certPath, "", "", false)
+	if err == nil {
+		t.Fatal("newTLSHTTPClient: expected error for invalid ca-cert, got nil")
+	}
+}
+
+func TestNewTLSHTTPClientLoadsClientCertPair(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	generateCert(t, certPath, keyPath)
+
+	client, err := newTLSHTTPClient("", certPath, keyPath, false)
+	if err != nil {
+		t.Fatalf("newTLSHTTPClient: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if len(transport.TLSClientConfig.Certificates) != 1 {
+		t.Fatalf("Certificates = %d, want 1", len(transport.TLSClientConfig.Certificates))
+	}
+}
+
+func TestNewTLSHTTPClientMismatchedClientCertKey(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	generateCert(t, certPath, keyPath)
+
+	otherKeyPath := filepath.Join(dir, "other.key")
+	generateCert(t, filepath.Join(dir, "other.pem"), otherKeyPath)
+
+	_, err := newTLSHTTPClient("", certPath, otherKeyPath, false)
+	if err == nil {
+		t.Fatal("newTLSHTTPClient: expected error for mismatched client-cert/client-key, got nil")
+	}
+}
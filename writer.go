@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/NeowayLabs/logger"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// ExportWriter encodes hits scanned from Elasticsearch into some output
+// format. WriteHeader is called once, before any EncodeDoc, so formats
+// that need a preamble (a CSV header row, a JSON array's opening
+// bracket) can emit it; it is not called when Exporter resumes from a
+// checkpoint, since the output already holds the preamble. EncodeDoc turns one hit into its on-disk
+// representation and may be called concurrently by several formatter
+// goroutines; WriteEncoded appends that representation to the
+// destination, in scan order, and is only ever called from a single
+// goroutine, so implementations don't need to make it safe for
+// concurrent use. Close is called once, after the last Flush.
+type ExportWriter interface {
+	WriteHeader(fields []string) error
+	EncodeDoc(hit *elastic.SearchHit) ([]byte, error)
+	WriteEncoded(data []byte) error
+	Flush() error
+	Close() error
+}
+
+// BytesWriter is an optional interface an ExportWriter can satisfy to
+// report how many bytes it has written so far. Exporter.Stats uses it
+// to report throughput.
+type BytesWriter interface {
+	BytesWritten() int64
+}
+
+// SourceOptionalWriter is an optional interface an ExportWriter can
+// satisfy to report that it never reads a hit's raw _source, so
+// Exporter can skip fetching it over the wire. Writers that don't
+// implement it, like NDJSONWriter and JSONArrayWriter, are assumed to
+// need _source.
+type SourceOptionalWriter interface {
+	NeedsSource() bool
+}
+
+// countingWriter wraps an io.Writer, counting the bytes that flow
+// through it so ExportWriter implementations can satisfy BytesWriter.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+func (cw *countingWriter) BytesWritten() int64 {
+	return atomic.LoadInt64(&cw.n)
+}
+
+// CSVWriter writes one semicolon separated row per document, reading
+// values from the scan query's Fields response. Multi valued fields are
+// flattened into a single cell joined by newlines.
+type CSVWriter struct {
+	w       *bufio.Writer
+	counter *countingWriter
+	closer  io.Closer
+	fields  []string
+}
+
+// NewCSVWriter returns an ExportWriter that encodes documents as CSV.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	counter := &countingWriter{w: w}
+	closer, _ := w.(io.Closer)
+	return &CSVWriter{w: bufio.NewWriter(counter), counter: counter, closer: closer}
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (cw *CSVWriter) BytesWritten() int64 {
+	return cw.counter.BytesWritten()
+}
+
+// NeedsSource returns false: CSVWriter reads only the scan query's
+// Fields response, never hit.Source.
+func (cw *CSVWriter) NeedsSource() bool {
+	return false
+}
+
+// WriteHeader writes the CSV header row and remembers the field order
+// so EncodeDoc knows which values to pull off each hit.
+func (cw *CSVWriter) WriteHeader(fields []string) error {
+	cw.fields = fields
+	data, err := encodeCSVRow(fields)
+	if err != nil {
+		return err
+	}
+	return cw.WriteEncoded(data)
+}
+
+// EncodeDoc encodes a single document as a CSV row. It allocates its
+// own csv.Writer over a scratch buffer so it can run concurrently with
+// other EncodeDoc calls: only cw.fields, set once before any call by
+// WriteHeader (or by Exporter when resuming from a checkpoint), is
+// shared.
+func (cw *CSVWriter) EncodeDoc(hit *elastic.SearchHit) ([]byte, error) {
+	var values []string
+	for _, field := range cw.fields {
+		if hit.Fields[field] == nil {
+			values = append(values, "")
+			continue
+		}
+
+		value := hit.Fields[field].([]interface{})
+		items := make([]string, len(value))
+
+		for i, item := range value {
+			switch t := item.(type) {
+			case string:
+				items[i] = item.(string)
+			case bool:
+				items[i] = fmt.Sprintf("%t", item)
+			case float64:
+				items[i] = fmt.Sprintf("%f", item)
+			default:
+				logger.Error("unexpected type %T\n", t)
+			}
+		}
+
+		values = append(values, strings.Join(items, "\n"))
+	}
+
+	return encodeCSVRow(values)
+}
+
+// encodeCSVRow renders values as a single semicolon separated CSV row.
+func encodeCSVRow(values []string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := csv.NewWriter(&buf)
+	enc.Comma = ';'
+	if err := enc.Write(values); err != nil {
+		return nil, err
+	}
+	enc.Flush()
+	if err := enc.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteEncoded appends an already encoded CSV row to the output.
+func (cw *CSVWriter) WriteEncoded(data []byte) error {
+	_, err := cw.w.Write(data)
+	return err
+}
+
+// Flush flushes buffered rows to the underlying writer.
+func (cw *CSVWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// Close closes the underlying writer, if it is closable.
+func (cw *CSVWriter) Close() error {
+	if cw.closer != nil {
+		return cw.closer.Close()
+	}
+	return nil
+}
+
+// NDJSONWriter writes one raw _source document per line. Unlike
+// CSVWriter it preserves nested objects and arrays instead of
+// flattening them into strings.
+type NDJSONWriter struct {
+	w       *bufio.Writer
+	counter *countingWriter
+	closer  io.Closer
+}
+
+// NewNDJSONWriter returns an ExportWriter that encodes documents as
+// newline delimited JSON.
+func NewNDJSONWriter(w io.Writer) *NDJSONWriter {
+	counter := &countingWriter{w: w}
+	closer, _ := w.(io.Closer)
+	return &NDJSONWriter{w: bufio.NewWriter(counter), counter: counter, closer: closer}
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (nw *NDJSONWriter) BytesWritten() int64 {
+	return nw.counter.BytesWritten()
+}
+
+// WriteHeader is a no-op, NDJSON has no preamble.
+func (nw *NDJSONWriter) WriteHeader(fields []string) error {
+	return nil
+}
+
+// EncodeDoc returns the hit's raw _source followed by a newline.
+func (nw *NDJSONWriter) EncodeDoc(hit *elastic.SearchHit) ([]byte, error) {
+	if hit.Source == nil {
+		return nil, nil
+	}
+	data := make([]byte, len(*hit.Source)+1)
+	copy(data, *hit.Source)
+	data[len(data)-1] = '\n'
+	return data, nil
+}
+
+// WriteEncoded appends an already encoded document line to the output.
+func (nw *NDJSONWriter) WriteEncoded(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	_, err := nw.w.Write(data)
+	return err
+}
+
+// Flush flushes buffered lines to the underlying writer.
+func (nw *NDJSONWriter) Flush() error {
+	return nw.w.Flush()
+}
+
+// Close closes the underlying writer, if it is closable.
+func (nw *NDJSONWriter) Close() error {
+	if nw.closer != nil {
+		return nw.closer.Close()
+	}
+	return nil
+}
+
+// JSONArrayWriter writes every document's raw _source as one element
+// of a single top level JSON array.
+type JSONArrayWriter struct {
+	w       *bufio.Writer
+	counter *countingWriter
+	closer  io.Closer
+	started bool
+}
+
+// NewJSONArrayWriter returns an ExportWriter that encodes documents as a
+// JSON array of their _source. resuming must be true when w already
+// holds a previous run's array elements with no closing ']' (a
+// checkpoint resume appending to -output), so the first document
+// written gets a leading comma instead of WriteHeader's skipped '['.
+func NewJSONArrayWriter(w io.Writer, resuming bool) *JSONArrayWriter {
+	counter := &countingWriter{w: w}
+	closer, _ := w.(io.Closer)
+	return &JSONArrayWriter{w: bufio.NewWriter(counter), counter: counter, closer: closer, started: resuming}
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (jw *JSONArrayWriter) BytesWritten() int64 {
+	return jw.counter.BytesWritten()
+}
+
+// WriteHeader opens the JSON array.
+func (jw *JSONArrayWriter) WriteHeader(fields []string) error {
+	return jw.w.WriteByte('[')
+}
+
+// EncodeDoc returns the hit's raw _source unchanged; the comma joining
+// it to the previous element is added by WriteEncoded, since whether
+// one is needed depends on write order rather than anything about the
+// hit itself.
+func (jw *JSONArrayWriter) EncodeDoc(hit *elastic.SearchHit) ([]byte, error) {
+	if hit.Source == nil {
+		return nil, nil
+	}
+	return []byte(*hit.Source), nil
+}
+
+// WriteEncoded appends an already encoded document as the next array
+// element, joining it to the previous one with a comma if needed.
+func (jw *JSONArrayWriter) WriteEncoded(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	if jw.started {
+		if err := jw.w.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	jw.started = true
+	_, err := jw.w.Write(data)
+	return err
+}
+
+// Flush flushes buffered data to the underlying writer.
+func (jw *JSONArrayWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+// Close closes the JSON array and the underlying writer, if it is
+// closable.
+func (jw *JSONArrayWriter) Close() error {
+	if err := jw.w.WriteByte(']'); err != nil {
+		return err
+	}
+	if err := jw.w.Flush(); err != nil {
+		return err
+	}
+	if jw.closer != nil {
+		return jw.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/olivere/elastic.v2"
+)
+
+func hitWithFields(fields map[string]interface{}) *elastic.SearchHit {
+	return &elastic.SearchHit{Fields: fields}
+}
+
+func hitWithSource(source string) *elastic.SearchHit {
+	raw := json.RawMessage(source)
+	return &elastic.SearchHit{Source: &raw}
+}
+
+func TestCSVWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSVWriter(&buf)
+
+	if w.NeedsSource() {
+		t.Fatal("CSVWriter.NeedsSource() = true, want false")
+	}
+
+	if err := w.WriteHeader([]string{"host", "status"}); err != nil {
+		t.Fatalf("WriteHeader: %s", err)
+	}
+
+	hit := hitWithFields(map[string]interface{}{
+		"host":   []interface{}{"a.example.com"},
+		"status": []interface{}{float64(200)},
+	})
+	data, err := w.EncodeDoc(hit)
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+	if err := w.WriteEncoded(data); err != nil {
+		t.Fatalf("WriteEncoded: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	want := "host;status\na.example.com;200.000000\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("CSV output = %q, want %q", got, want)
+	}
+}
+
+func TestCSVWriterMissingFieldIsBlank(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSVWriter(&buf)
+	w.WriteHeader([]string{"host", "status"})
+
+	data, err := w.EncodeDoc(hitWithFields(map[string]interface{}{
+		"host": []interface{}{"a.example.com"},
+	}))
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+	w.WriteEncoded(data)
+	w.Flush()
+
+	want := "host;status\na.example.com;\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("CSV output = %q, want %q", got, want)
+	}
+}
+
+func TestNDJSONWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewNDJSONWriter(&buf)
+
+	if err := w.WriteHeader([]string{"host"}); err != nil {
+		t.Fatalf("WriteHeader: %s", err)
+	}
+
+	for _, src := range []string{`{"host":"a"}`, `{"host":"b"}`} {
+		data, err := w.EncodeDoc(hitWithSource(src))
+		if err != nil {
+			t.Fatalf("EncodeDoc: %s", err)
+		}
+		if err := w.WriteEncoded(data); err != nil {
+			t.Fatalf("WriteEncoded: %s", err)
+		}
+	}
+	w.Flush()
+
+	want := "{\"host\":\"a\"}\n{\"host\":\"b\"}\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("NDJSON output = %q, want %q", got, want)
+	}
+}
+
+func TestJSONArrayWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONArrayWriter(&buf, false)
+
+	if err := w.WriteHeader(nil); err != nil {
+		t.Fatalf("WriteHeader: %s", err)
+	}
+
+	// EncodeDoc is called out of write order here to exercise that the
+	// writer, not the encoder, is what decides comma placement.
+	docB, err := w.EncodeDoc(hitWithSource(`{"host":"b"}`))
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+	docA, err := w.EncodeDoc(hitWithSource(`{"host":"a"}`))
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+
+	if err := w.WriteEncoded(docA); err != nil {
+		t.Fatalf("WriteEncoded: %s", err)
+	}
+	if err := w.WriteEncoded(docB); err != nil {
+		t.Fatalf("WriteEncoded: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	want := `[{"host":"a"},{"host":"b"}]`
+	if got := buf.String(); got != want {
+		t.Fatalf("JSON array output = %q, want %q", got, want)
+	}
+}
+
+// TestJSONArrayWriterResume is a regression test for a reviewer finding
+// where resuming a -format json export appended new elements straight
+// after the previous run's last element with no separating comma,
+// since WriteHeader (which opens the array) is skipped on resume and
+// started defaulted to false regardless. NewJSONArrayWriter's resuming
+// argument is how main.go tells the writer the array is already open.
+func TestJSONArrayWriterResume(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`[{"host":"a"}`)
+
+	w := NewJSONArrayWriter(&buf, true)
+
+	data, err := w.EncodeDoc(hitWithSource(`{"host":"b"}`))
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+	if err := w.WriteEncoded(data); err != nil {
+		t.Fatalf("WriteEncoded: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	want := `[{"host":"a"},{"host":"b"}]`
+	if got := buf.String(); got != want {
+		t.Fatalf("JSON array output = %q, want %q", got, want)
+	}
+}
+
+func TestJSONArrayWriterSkipsMissingSource(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONArrayWriter(&buf, false)
+	w.WriteHeader(nil)
+
+	data, err := w.EncodeDoc(&elastic.SearchHit{})
+	if err != nil {
+		t.Fatalf("EncodeDoc: %s", err)
+	}
+	if data != nil {
+		t.Fatalf("EncodeDoc with no _source = %v, want nil", data)
+	}
+	if err := w.WriteEncoded(data); err != nil {
+		t.Fatalf("WriteEncoded: %s", err)
+	}
+	w.Close()
+
+	want := "[]"
+	if got := buf.String(); got != want {
+		t.Fatalf("JSON array output = %q, want %q", got, want)
+	}
+}